@@ -1,13 +1,9 @@
 package main
 
 import (
-	"encoding/json"
-	"net/http"
-	"strconv"
+	"context"
 	"strings"
-	"time"
 
-	"github.com/sersert/prometheus-rancher-exporter/measure"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -91,55 +87,29 @@ func (e *Exporter) processMetrics(data *Data, endpoint string, hideSys bool, ch
 
 		log.Debugf("Processing metrics for %s", endpoint)
 
-		if endpoint == "hosts" {
-			filteredLabels = e.allowedLabels(x.Labels)
-			var s = x.HostName
-			if x.Name != "" {
-				s = x.Name
-			}
-			e.setHostStateMetrics(s, x.State, x.AgentState, filteredLabels)
-			if x.HostInfo != nil {
-				e.setHostInfoMetrics(s, x.HostInfo, filteredLabels)
-			}
-		} else if endpoint == "stacks" {
-			// Used to create a map of stackID and stackName
-			// Later used as a dimension in service metrics
-			stackRef = storeStackRef(x.ID, x.Name)
-
-			e.setStackMetrics(x.Name, x.State, x.HealthState, strconv.FormatBool(x.System))
-		} else if endpoint == "services" {
-			// Retrieves the stack Name from the previous values stored.
-			var stackName = retrieveStackRef(x.StackID)
-
-			if stackName == "unknown" {
-				log.Warnf("Failed to obtain stack_name for %s from the API", x.Name)
-			}
-
-			if x.LaunchConfig != nil && len(x.LaunchConfig.Labels) > 0 {
-				filteredLabels = e.allowedLabels(x.LaunchConfig.Labels)
-			}
-
-			e.setServiceMetrics(x.Name, stackName, x.State, x.HealthState, x.Scale, filteredLabels)
+		// Reference maps still need populating ahead of the generators below,
+		// since service/node generators resolve stack_name/cluster_name from
+		// them.
+		if endpoint == "stacks" {
+			storeStackRef(x.ID, x.Name)
 		} else if endpoint == "clusters" {
-			clusterRef = storeClusterRef(x.ID, x.Name)
-			e.setClusterMetrics(x.Name, x.State, x.ComponentStatuses)
-		} else if endpoint == "nodes" {
-			// Retrieves the cluster Name from the previous values stored.
-			var clusterName = retrieveClusterRef(x.ClusterID)
-
-			if clusterName == "unknown" {
-				log.Warnf("Failed to obtain cluster_name for %s from the API", x.NodeName)
-			}
+			storeClusterRef(x.ID, x.Name)
+		}
 
-			e.setNodeMetrics(x.NodeName, x.State, clusterName)
+		if endpoint == "hosts" {
+			filteredLabels = e.allowedLabels(x.Labels)
+		} else if endpoint == "services" && x.LaunchConfig != nil && len(x.LaunchConfig.Labels) > 0 {
+			filteredLabels = e.allowedLabels(x.LaunchConfig.Labels)
 		}
+
+		e.emitFamilies(endpoint, &x, filteredLabels, ch)
 	}
 
 	return nil
 }
 
 // gatherData - Collects the data from thw API, invokes functions to transform that data into metrics
-func (e *Exporter) gatherData(rancherURL string, resourceLimit string, accessKey string, secretKey string, endpoint string, ch chan<- prometheus.Metric) (*Data, error) {
+func (e *Exporter) gatherData(ctx context.Context, rancherURL string, resourceLimit string, accessKey string, secretKey string, endpoint string, ch chan<- prometheus.Metric) (*Data, error) {
 	// Return the correct URL path
 	url := setEndpoint(rancherURL, endpoint, resourceLimit)
 
@@ -147,9 +117,9 @@ func (e *Exporter) gatherData(rancherURL string, resourceLimit string, accessKey
 	var data = new(Data)
 
 	// Scrape EndPoint for JSON Data
-	err := getJSON(url, accessKey, secretKey, &data)
+	err := e.httpClient.Get(ctx, endpoint, url, accessKey, secretKey, data)
 	if err != nil {
-		log.Error("Error getting JSON from endpoint ", endpoint)
+		log.Error("Error getting JSON from endpoint ", endpoint, ": ", err)
 		return nil, err
 	}
 	log.Debugf("JSON Fetched for: "+endpoint+": %+v", data)
@@ -167,94 +137,53 @@ func (e *Exporter) allowedLabels(labels map[string]string) map[string]string {
 	return result
 }
 
-// getJSON return json from server, return the formatted JSON
-func getJSON(url string, accessKey string, secretKey string, target interface{}) error {
-	start := time.Now()
-
-	// Counter for internal exporter metrics
-	measure.FunctionCountTotal.With(prometheus.Labels{"pkg": "main", "fnc": "getJSON"}).Inc()
-
-	log.Info("Scraping: ", url)
-
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", url, nil)
-
-	if err != nil {
-		log.Error("Error Collecting JSON from API: ", err)
-	}
-
-	req.SetBasicAuth(accessKey, secretKey)
-	resp, err := client.Do(req)
-
-	if err != nil {
-		log.Error("Error Collecting JSON from API: ", err)
-	}
-
-	if resp.StatusCode != 200 {
-		log.Error("Error Collecting JSON from API: ", resp.Status)
-	}
-
-	respFormatted := json.NewDecoder(resp.Body).Decode(target)
-
-	// Timings recorded as part of internal metrics
-	elapsed := float64((time.Since(start)) / time.Microsecond)
-	measure.FunctionDurations.WithLabelValues("main", "getJSON").Observe(elapsed)
-
-	// Close the response body, the underlying Transport should then close the connection.
-	resp.Body.Close()
-
-	// return formatted JSON
-	return respFormatted
-}
-
 // setEndpoint - Determines the correct URL endpoint to use, gives us backwards compatibility
 func setEndpoint(rancherURL string, component string, resourceLimit string) string {
 	var endpoint string
 
+	if *rancherAPIVersion == apiVersionV3 {
+		return rancherURL + "/" + component
+	}
+
 	endpoint = (rancherURL + "/" + component + "/" + "?limit=" + resourceLimit)
 	endpoint = strings.Replace(endpoint, "v1", "v2-beta", 1)
 
 	return endpoint
 }
 
-// storeStackRef stores the stackID and stack name for use as a label elsewhere
-func storeStackRef(stackID string, stackName string) map[string]string {
-	stackRef[stackID] = stackName
+// stackRef and clusterRef back retrieveStackRef/retrieveClusterRef with a
+// RefCache instead of the O(n) range-over-map lookups the exporter used to
+// do on every service/node processed, and are safe to read and write from
+// the concurrent scrape workers added in scrapeAll.
+var (
+	stackRef   = NewRefCache()
+	clusterRef = NewRefCache()
+)
 
-	return stackRef
+// storeStackRef stores the stackID and stack name for use as a label elsewhere
+func storeStackRef(stackID string, stackName string) {
+	stackRef.Set(stackID, stackName)
 }
 
 // retrieveStackRef returns the stack name, when sending the stackID
 func retrieveStackRef(stackID string) string {
-	for key, value := range stackRef {
-		if stackID == "" {
-			return "unknown"
-		} else if stackID == key {
-			log.Debugf("StackRef - Key is %s, Value is %s StackID is %s", key, value, stackID)
-			return value
-		}
+	name := stackRef.GetOrUnknown(stackID)
+	if name != "unknown" {
+		log.Debugf("StackRef - Value is %s StackID is %s", name, stackID)
 	}
-	// returns unknown if no match was found
-	return "unknown"
+	return name
 }
 
 // storeClusterRef stores the clusterID and cluster name for use as a label elsewhere
-func storeClusterRef(clusterID string, clusterName string) map[string]string {
-	clusterRef[clusterID] = clusterName
-
-	return clusterRef
+func storeClusterRef(clusterID string, clusterName string) {
+	clusterRef.Set(clusterID, clusterName)
 }
 
 // retrieveClusterRef returns the cluster name, when sending the clusterID
 func retrieveClusterRef(clusterID string) string {
-	for key, value := range clusterRef {
-		if clusterID == "" {
-			return "unknown"
-		} else if clusterID == key {
-			log.Debugf("ClusterRef - Key is %s, Value is %s ClusterID is %s", key, value, clusterID)
-			return value
-		}
+	name := clusterRef.GetOrUnknown(clusterID)
+	if name != "unknown" {
+		log.Debugf("ClusterRef - Value is %s ClusterID is %s", name, clusterID)
 	}
-	// returns unknown if no match was found
-	return "unknown"
+	return name
 }
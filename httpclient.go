@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	rancherTimeout = kingpin.Flag("rancher.timeout", "Timeout for a single request against the Rancher API.").Default("10s").Duration()
+
+	rancherTLSInsecureSkipVerify = kingpin.Flag("rancher.tls-insecure-skip-verify", "Skip TLS certificate verification when talking to the Rancher API.").Default("false").Bool()
+
+	rancherCAFile = kingpin.Flag("rancher.ca-file", "Path to a PEM-encoded CA bundle used to verify the Rancher API's certificate.").Default("").String()
+
+	rancherRetries = kingpin.Flag("rancher.retries", "Number of times to retry a failed request against the Rancher API.").Default("3").Int()
+
+	rancherRetryBackoff = kingpin.Flag("rancher.retry-backoff", "Base backoff duration between retries; doubled on every attempt.").Default("500ms").Duration()
+)
+
+// apiRequestDuration and apiRequestsTotal let users alert on Rancher API
+// health directly, broken down per endpoint and response code, rather than
+// inferring it from the internal measure package's function-level timings.
+var (
+	apiRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "rancher_api_request_duration_seconds",
+			Help: "Duration of requests made against the Rancher API",
+		},
+		[]string{"endpoint", "code"},
+	)
+
+	apiRequestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "rancher_api_requests_total",
+			Help: "Total number of requests made against the Rancher API",
+		},
+		[]string{"endpoint", "code"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(apiRequestDuration, apiRequestsTotal)
+}
+
+// apiClient owns the single *http.Client every Rancher API request is made
+// through, so keep-alives are reused instead of a fresh connection per call.
+type apiClient struct {
+	client *http.Client
+}
+
+// newAPIClient builds an apiClient from the rancher.timeout/tls-insecure-
+// skip-verify/ca-file flags.
+func newAPIClient() (*apiClient, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: *rancherTLSInsecureSkipVerify}
+
+	if *rancherCAFile != "" {
+		pem, err := ioutil.ReadFile(*rancherCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading rancher.ca-file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in rancher.ca-file %s", *rancherCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	return &apiClient{
+		client: &http.Client{
+			Timeout: *rancherTimeout,
+			Transport: &http.Transport{
+				MaxIdleConnsPerHost: 10,
+				TLSClientConfig:     tlsConfig,
+			},
+		},
+	}, nil
+}
+
+// Get fetches url, authenticating with accessKey/secretKey (or the v3
+// bearer token), retrying transport errors and 429/503 responses with
+// backoff, and decodes the response body into target.
+func (c *apiClient) Get(ctx context.Context, endpoint, url, accessKey, secretKey string, target interface{}) error {
+	return c.get(ctx, endpoint, url, target, func(req *http.Request) {
+		if *rancherAPIVersion == apiVersionV3 {
+			req.Header.Set("Authorization", "Bearer "+*rancherBearerToken)
+		} else {
+			req.SetBasicAuth(accessKey, secretKey)
+		}
+	})
+}
+
+// GetWithHeaders fetches url like Get, but sets arbitrary headers on the
+// request instead of Rancher API credentials, for non-Cattle backends like
+// metadataProvider.
+func (c *apiClient) GetWithHeaders(ctx context.Context, endpoint, url string, headers map[string]string, target interface{}) error {
+	return c.get(ctx, endpoint, url, target, func(req *http.Request) {
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+	})
+}
+
+// get is the retry loop shared by Get/GetWithHeaders; configureRequest sets
+// whatever the caller needs on the request (Rancher credentials, or plain
+// headers) before it is sent.
+func (c *apiClient) get(ctx context.Context, endpoint, url string, target interface{}, configureRequest func(*http.Request)) error {
+	var lastErr error
+
+	for attempt := 0; attempt <= *rancherRetries; attempt++ {
+		code, retryAfter, err := c.do(ctx, endpoint, url, target, configureRequest)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		if !retriable(code) || attempt == *rancherRetries {
+			return err
+		}
+
+		wait := retryAfter
+		if wait == 0 {
+			wait = backoff(attempt)
+		}
+		log.Warnf("Retrying %s after error (attempt %d/%d, waiting %s): %v", endpoint, attempt+1, *rancherRetries, wait, err)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	return lastErr
+}
+
+// do performs a single request/decode attempt, returning the HTTP status
+// code observed (0 if the request never got a response), a Retry-After
+// duration if the response carried one, and any error. The request is
+// bound to ctx, so a cancelled/expired scrape deadline aborts the in-flight
+// request instead of merely abandoning it.
+func (c *apiClient) do(ctx context.Context, endpoint, url string, target interface{}, configureRequest func(*http.Request)) (int, time.Duration, error) {
+	start := time.Now()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("building request for %s: %w", endpoint, err)
+	}
+
+	configureRequest(req)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		c.observe(endpoint, "error", start)
+		return 0, 0, fmt.Errorf("requesting %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	c.observe(endpoint, strconv.Itoa(resp.StatusCode), start)
+
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, retryAfter(resp.Header.Get("Retry-After")), fmt.Errorf("%s returned %s", endpoint, resp.Status)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(target); err != nil {
+		return resp.StatusCode, 0, fmt.Errorf("decoding response from %s: %w", endpoint, err)
+	}
+
+	return resp.StatusCode, 0, nil
+}
+
+func (c *apiClient) observe(endpoint, code string, start time.Time) {
+	apiRequestDuration.WithLabelValues(endpoint, code).Observe(time.Since(start).Seconds())
+	apiRequestsTotal.WithLabelValues(endpoint, code).Inc()
+}
+
+// retriable reports whether a request that failed with the given status
+// code (0 meaning no response was received at all) is worth retrying.
+func retriable(code int) bool {
+	return code == 0 || code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable
+}
+
+// backoff returns the exponential delay before the given retry attempt,
+// doubling rancher.retry-backoff each time.
+func backoff(attempt int) time.Duration {
+	return time.Duration(math.Pow(2, float64(attempt))) * *rancherRetryBackoff
+}
+
+// retryAfter parses a 429/503 response's Retry-After header, expressed in
+// seconds, returning 0 if it is absent or malformed.
+func retryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,410 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	metricAllowlist = kingpin.Flag("metric-allowlist", "Comma separated list of metric families to enable. If empty, all registered families are enabled.").Default("").String()
+
+	metricDenylist = kingpin.Flag("metric-denylist", "Comma separated list of metric families to disable.").Default("").String()
+
+	metricLabelsAllowlist = kingpin.Flag("metric-labels-allowlist", "Semicolon separated list of endpoint=[label,label] mappings restricting which labels a family may carry, e.g. hosts=[env,role];services=[team].").Default("").String()
+)
+
+// Metric is a single emitted sample: its label values (in the order declared
+// by the owning MetricFamily) and its value. The family name comes from the
+// MetricFamily whose Generate produced it.
+type Metric struct {
+	LabelValues []string
+	Value       float64
+}
+
+// MetricFamily describes one kube-state-metrics style generator: a name,
+// help text and label schema, plus the function that turns a Data item into
+// zero or more Metrics. Adding a new field from the Rancher JSON is then a
+// matter of registering a MetricFamily, not touching processMetrics.
+type MetricFamily struct {
+	Name      string
+	Help      string
+	Endpoint  string
+	Labels    []string
+	ValueType prometheus.ValueType
+	Generate  func(x *DataItem) []Metric
+}
+
+// DataItem is the per-element shape of Data.Data, pulled out so generators
+// don't need to depend on the anonymous struct field.
+type DataItem = struct {
+	HealthState string            `json:"healthState"`
+	Name        string            `json:"name"`
+	State       string            `json:"state"`
+	System      bool              `json:"system"`
+	Scale       int               `json:"scale"`
+	HostName    string            `json:"hostname"`
+	ID          string            `json:"id"`
+	StackID     string            `json:"stackId"`
+	EnvID       string            `json:"environmentId"`
+	BaseType    string            `json:"basetype"`
+	Type        string            `json:"type"`
+	AgentState  string            `json:"agentState"`
+	Labels      map[string]string `json:"labels"`
+	ClusterID   string            `json:"clusterId"`
+	NodeName    string            `json:"nodeName"`
+
+	HostInfo *HostInfo `json:"info"`
+
+	LaunchConfig *LaunchConfig `json:"launchConfig"`
+
+	ComponentStatuses []*ComponentStatuses `json:"componentStatuses"`
+}
+
+// registry holds every enabled MetricFamily as a slice in registration
+// order, so that Collect output is deterministic.
+type registry struct {
+	families []*MetricFamily
+	labels   map[string][]string
+}
+
+// newRegistry builds the default set of metric families, matching the
+// fields the hand-written setHostStateMetrics/setStackMetrics/
+// setServiceMetrics/setClusterMetrics/setNodeMetrics functions used to emit
+// (including HostInfo.CPUInfo/MemoryInfo), plus the previously-unused
+// HostInfo.DiskInfo.MountPoints data.
+func newRegistry() *registry {
+	r := &registry{labels: parseMetricLabelsAllowlist(*metricLabelsAllowlist)}
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_state",
+		Help:      "State of the host (1 active, 0 for others)",
+		Endpoint:  "hosts",
+		Labels:    []string{"name", "state"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return []Metric{{LabelValues: []string{hostDisplayName(x), x.State}, Value: 1}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_agent_state",
+		Help:      "State of the host agent (1 active, 0 for others)",
+		Endpoint:  "hosts",
+		Labels:    []string{"name", "agent_state"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return []Metric{{LabelValues: []string{hostDisplayName(x), x.AgentState}, Value: 1}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_cpu_count",
+		Help:      "Number of CPUs reported by the host",
+		Endpoint:  "hosts",
+		Labels:    []string{"name"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			if x.HostInfo == nil {
+				return nil
+			}
+			return []Metric{{LabelValues: []string{hostDisplayName(x)}, Value: float64(x.HostInfo.CPUInfo.Count)}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_memory_total_bytes",
+		Help:      "Total memory in bytes reported by the host",
+		Endpoint:  "hosts",
+		Labels:    []string{"name"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			if x.HostInfo == nil {
+				return nil
+			}
+			return []Metric{{LabelValues: []string{hostDisplayName(x)}, Value: float64(x.HostInfo.MemoryInfo.MemTotal)}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_memory_free_bytes",
+		Help:      "Free memory in bytes reported by the host",
+		Endpoint:  "hosts",
+		Labels:    []string{"name"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			if x.HostInfo == nil {
+				return nil
+			}
+			return []Metric{{LabelValues: []string{hostDisplayName(x)}, Value: float64(x.HostInfo.MemoryInfo.MemFree)}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_disk_mountpoint_total_bytes",
+		Help:      "Total size in bytes of a host disk mount point",
+		Endpoint:  "hosts",
+		Labels:    []string{"name", "mount_point"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return diskMountMetrics(x, func(m MountPoint) float64 { return float64(m.Total) })
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_host_disk_mountpoint_used_bytes",
+		Help:      "Used size in bytes of a host disk mount point",
+		Endpoint:  "hosts",
+		Labels:    []string{"name", "mount_point"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return diskMountMetrics(x, func(m MountPoint) float64 { return float64(m.Used) })
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_stack_state",
+		Help:      "State of the stack (1 active, 0 for others)",
+		Endpoint:  "stacks",
+		Labels:    []string{"name", "state", "health_state", "system"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return []Metric{{LabelValues: []string{x.Name, x.State, x.HealthState, boolString(x.System)}, Value: 1}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_service_state",
+		Help:      "State of the service (1 active, 0 for others)",
+		Endpoint:  "services",
+		Labels:    []string{"name", "stack_name", "state", "health_state"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			stackName := retrieveStackRef(x.StackID)
+			return []Metric{{LabelValues: []string{x.Name, stackName, x.State, x.HealthState}, Value: 1}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_service_scale",
+		Help:      "Scale of the service, number of instances requested",
+		Endpoint:  "services",
+		Labels:    []string{"name", "stack_name"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			stackName := retrieveStackRef(x.StackID)
+			return []Metric{{LabelValues: []string{x.Name, stackName}, Value: float64(x.Scale)}}
+		},
+	})
+
+	// clusters/nodes are shaped differently under --rancher.api-version=v3
+	// (Kubernetes objects rather than Cattle ones), so registerV3Families
+	// registers its own rancher_cluster_state/rancher_node_state instead.
+	if *rancherAPIVersion == apiVersionV3 {
+		r.registerV3Families()
+		return r
+	}
+
+	r.register(&MetricFamily{
+		Name:      "rancher_cluster_state",
+		Help:      "State of the cluster (1 active, 0 for others)",
+		Endpoint:  "clusters",
+		Labels:    []string{"name", "state"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			return []Metric{{LabelValues: []string{x.Name, x.State}, Value: 1}}
+		},
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_node_state",
+		Help:      "State of the node (1 active, 0 for others)",
+		Endpoint:  "nodes",
+		Labels:    []string{"name", "cluster_name", "state"},
+		ValueType: prometheus.GaugeValue,
+		Generate: func(x *DataItem) []Metric {
+			clusterName := retrieveClusterRef(x.ClusterID)
+			return []Metric{{LabelValues: []string{x.NodeName, clusterName, x.State}, Value: 1}}
+		},
+	})
+
+	return r
+}
+
+// register appends a family unless it has been excluded by
+// metric-allowlist/metric-denylist.
+func (r *registry) register(f *MetricFamily) {
+	if !familyEnabled(f.Name) {
+		log.Debugf("Metric family %s disabled by allowlist/denylist", f.Name)
+		return
+	}
+	r.families = append(r.families, f)
+}
+
+// forEndpoint returns the families registered against the given endpoint.
+func (r *registry) forEndpoint(endpoint string) []*MetricFamily {
+	var out []*MetricFamily
+	for _, f := range r.families {
+		if f.Endpoint == endpoint {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// hostDisplayName prefers Name over HostName, falling back to HostName when
+// Name is empty.
+func hostDisplayName(x *DataItem) string {
+	if x.Name != "" {
+		return x.Name
+	}
+	return x.HostName
+}
+
+// diskMountMetrics walks HostInfo.DiskInfo.MountPoints, previously unused,
+// and emits one Metric per mount point using the supplied value extractor.
+func diskMountMetrics(x *DataItem, value func(MountPoint) float64) []Metric {
+	if x.HostInfo == nil {
+		return nil
+	}
+	metrics := make([]Metric, 0, len(x.HostInfo.DiskInfo.MountPoints))
+	for mountPoint, info := range x.HostInfo.DiskInfo.MountPoints {
+		metrics = append(metrics, Metric{
+			LabelValues: []string{hostDisplayName(x), mountPoint},
+			Value:       value(info),
+		})
+	}
+	return metrics
+}
+
+func boolString(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+// familyEnabled applies metric-allowlist then metric-denylist, matching the
+// precedence kube-state-metrics uses for its own --metric-allowlist and
+// --metric-denylist flags.
+func familyEnabled(name string) bool {
+	allow := splitList(*metricAllowlist)
+	if len(allow) > 0 && !contains(allow, name) {
+		return false
+	}
+
+	deny := splitList(*metricDenylist)
+	return !contains(deny, name)
+}
+
+// parseMetricLabelsAllowlist parses flags of the form
+// "hosts=[env,role];services=[team]" into a per-endpoint set of allowed
+// label keys.
+func parseMetricLabelsAllowlist(flag string) map[string][]string {
+	result := make(map[string][]string)
+	if flag == "" {
+		return result
+	}
+
+	for _, entry := range strings.Split(flag, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		endpoint := strings.TrimSpace(parts[0])
+		labels := strings.Trim(strings.TrimSpace(parts[1]), "[]")
+		result[endpoint] = splitList(labels)
+	}
+	return result
+}
+
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	var out []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func contains(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// emitFamilies runs every family registered for endpoint against x and
+// writes the resulting samples to ch, appending the keys configured for
+// endpoint via --metric-labels-allowlist as additional label dimensions,
+// valued from extraLabels (see allowedLabelKeys).
+func (e *Exporter) emitFamilies(endpoint string, x *DataItem, extraLabels map[string]string, ch chan<- prometheus.Metric) {
+	extraKeys, extraValues := sortedLabelPairs(e.allowedLabelKeys(endpoint, extraLabels))
+
+	for _, family := range e.metricRegistry.forEndpoint(endpoint) {
+		// Families such as the v3 ones registered by registerV3Families have
+		// no Generate: they are emitted via processV3Item/emitV3Metric
+		// instead, against a differently-shaped V3Item. Skip them here
+		// rather than calling a nil func.
+		if family.Generate == nil {
+			continue
+		}
+
+		desc := prometheus.NewDesc(family.Name, family.Help, append(append([]string{}, family.Labels...), extraKeys...), nil)
+
+		for _, m := range family.Generate(x) {
+			values := append(append([]string{}, m.LabelValues...), extraValues...)
+			ch <- prometheus.MustNewConstMetric(desc, family.ValueType, m.Value, values...)
+		}
+	}
+}
+
+// allowedLabelKeys returns the fixed set of labels configured via
+// --metric-labels-allowlist for this endpoint, defaulting any allowed key
+// missing from labels to "". Every item processed for a family must share
+// this same key set: client_golang's registry rejects a Collect where the
+// same metric name is emitted with two different label-dimension Descs, and
+// labels (arbitrary Rancher host/service labels) vary freely per item. If no
+// allowlist entry was configured for this endpoint, no extra labels are
+// emitted at all, since there is then no fixed key set to default to.
+func (e *Exporter) allowedLabelKeys(endpoint string, labels map[string]string) map[string]string {
+	allowed, ok := e.metricRegistry.labels[endpoint]
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]string, len(allowed))
+	for _, key := range allowed {
+		result[key] = labels[key]
+	}
+	return result
+}
+
+// sortedLabelPairs turns a label map into parallel, deterministically
+// ordered key/value slices so repeated calls build an identical Desc.
+func sortedLabelPairs(labels map[string]string) ([]string, []string) {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, k := range keys {
+		values[i] = labels[k]
+	}
+	return keys, values
+}
@@ -0,0 +1,126 @@
+package main
+
+import "testing"
+
+func TestParseMetricLabelsAllowlist(t *testing.T) {
+	got := parseMetricLabelsAllowlist("hosts=[env,role];services=[team]")
+
+	want := map[string][]string{
+		"hosts":    {"env", "role"},
+		"services": {"team"},
+	}
+
+	for endpoint, labels := range want {
+		gotLabels, ok := got[endpoint]
+		if !ok {
+			t.Fatalf("parseMetricLabelsAllowlist(...)[%s] missing, want %v", endpoint, labels)
+		}
+		if len(gotLabels) != len(labels) {
+			t.Fatalf("parseMetricLabelsAllowlist(...)[%s] = %v, want %v", endpoint, gotLabels, labels)
+		}
+		for i, l := range labels {
+			if gotLabels[i] != l {
+				t.Fatalf("parseMetricLabelsAllowlist(...)[%s] = %v, want %v", endpoint, gotLabels, labels)
+			}
+		}
+	}
+}
+
+func TestParseMetricLabelsAllowlistEmpty(t *testing.T) {
+	if got := parseMetricLabelsAllowlist(""); len(got) != 0 {
+		t.Fatalf("parseMetricLabelsAllowlist(\"\") = %v, want empty", got)
+	}
+}
+
+func TestNewRegistryEmitsHostCPUAndMemoryFamilies(t *testing.T) {
+	r := newRegistry()
+
+	host := &DataItem{
+		Name: "host-a",
+		HostInfo: &HostInfo{
+			CPUInfo: struct {
+				Count int `json:"count"`
+			}{Count: 4},
+			MemoryInfo: struct {
+				MemTotal int `json:"memTotal"`
+				MemFree  int `json:"memFree"`
+			}{MemTotal: 8192, MemFree: 2048},
+		},
+	}
+
+	want := map[string]float64{
+		"rancher_host_cpu_count":          4,
+		"rancher_host_memory_total_bytes": 8192,
+		"rancher_host_memory_free_bytes":  2048,
+	}
+
+	for _, family := range r.forEndpoint("hosts") {
+		value, ok := want[family.Name]
+		if !ok {
+			continue
+		}
+		metrics := family.Generate(host)
+		if len(metrics) != 1 || metrics[0].Value != value {
+			t.Fatalf("%s.Generate(host) = %v, want a single metric with value %v", family.Name, metrics, value)
+		}
+		delete(want, family.Name)
+	}
+
+	if len(want) != 0 {
+		t.Fatalf("registry is missing families: %v", want)
+	}
+}
+
+// TestAllowedLabelKeysFixedSchema guards against two items of the same
+// endpoint (e.g. two hosts with different sets of matched Rancher labels)
+// producing different label-dimension Descs for the same family, which
+// client_golang's registry rejects.
+func TestAllowedLabelKeysFixedSchema(t *testing.T) {
+	e := &Exporter{metricRegistry: &registry{labels: map[string][]string{"hosts": {"env", "role"}}}}
+
+	a := e.allowedLabelKeys("hosts", map[string]string{"env": "prod"})
+	b := e.allowedLabelKeys("hosts", map[string]string{"role": "worker"})
+
+	for _, got := range []map[string]string{a, b} {
+		if len(got) != 2 {
+			t.Fatalf("allowedLabelKeys(...) = %v, want exactly the 2 configured keys", got)
+		}
+	}
+	if a["role"] != "" {
+		t.Fatalf("allowedLabelKeys(...)[role] = %q, want \"\" when absent from this item's labels", a["role"])
+	}
+	if b["env"] != "" {
+		t.Fatalf("allowedLabelKeys(...)[env] = %q, want \"\" when absent from this item's labels", b["env"])
+	}
+}
+
+func TestAllowedLabelKeysNoAllowlistConfigured(t *testing.T) {
+	e := &Exporter{metricRegistry: &registry{labels: map[string][]string{}}}
+
+	got := e.allowedLabelKeys("hosts", map[string]string{"env": "prod"})
+	if len(got) != 0 {
+		t.Fatalf("allowedLabelKeys(...) = %v, want no extra labels: unbounded per-item keys can't share a fixed Desc", got)
+	}
+}
+
+func TestFamilyEnabledAllowlistDenylistPrecedence(t *testing.T) {
+	old, oldDeny := *metricAllowlist, *metricDenylist
+	defer func() { *metricAllowlist, *metricDenylist = old, oldDeny }()
+
+	*metricAllowlist = "rancher_host_state"
+	if !familyEnabled("rancher_host_state") {
+		t.Fatalf("familyEnabled(rancher_host_state) = false, want true: it is on the allowlist")
+	}
+	if familyEnabled("rancher_stack_state") {
+		t.Fatalf("familyEnabled(rancher_stack_state) = true, want false: it is not on the allowlist")
+	}
+
+	*metricAllowlist = "rancher_host_state,rancher_stack_state"
+	*metricDenylist = "rancher_stack_state"
+	if familyEnabled("rancher_stack_state") {
+		t.Fatalf("familyEnabled(rancher_stack_state) = true, want false: the denylist applies after the allowlist")
+	}
+	if !familyEnabled("rancher_host_state") {
+		t.Fatalf("familyEnabled(rancher_host_state) = false, want true: it is allowlisted and not denylisted")
+	}
+}
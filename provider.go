@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	metadataEnabled = kingpin.Flag("rancher.metadata", "Use the Rancher metadata service instead of polling the Cattle API.").Default("false").Bool()
+
+	metadataURL = kingpin.Flag("rancher.metadata-url", "Base URL of the Rancher metadata service.").Default("http://rancher-metadata/latest").String()
+
+	metadataPollInterval = kingpin.Flag("rancher.metadata-poll-interval", "Interval to poll the metadata service when long polling is disabled.").Default("5s").Duration()
+
+	metadataLongPoll = kingpin.Flag("rancher.metadata-long-poll", "Block on the metadata version endpoint and re-fetch as soon as it changes, instead of polling on a fixed interval.").Default("true").Bool()
+)
+
+// Provider is the common source of host/stack/service/cluster/node data,
+// letting processMetrics consume the same Data shape from either the Cattle
+// API or the Rancher metadata service.
+type Provider interface {
+	// Fetch returns the Data for the given endpoint ("hosts", "stacks",
+	// "services", "clusters" or "nodes").
+	Fetch(ctx context.Context, endpoint string) (*Data, error)
+}
+
+// provider selects which Provider backs a scrape of endpoint: the Cattle
+// API by default, or the Rancher metadata service when --rancher.metadata
+// is set and the metadata service actually has an endpoint for it (it has
+// no equivalent of "nodes", so that endpoint always falls back to
+// apiProvider, metadata mode or not).
+func (e *Exporter) provider(endpoint, rancherURL, resourceLimit, accessKey, secretKey string, ch chan<- prometheus.Metric) Provider {
+	if *metadataEnabled && metadataSupports(endpoint) {
+		return newMetadataProvider(e.httpClient)
+	}
+	return &apiProvider{
+		exporter:      e,
+		rancherURL:    rancherURL,
+		resourceLimit: resourceLimit,
+		accessKey:     accessKey,
+		secretKey:     secretKey,
+		ch:            ch,
+	}
+}
+
+// metadataSupports reports whether the metadata service has an endpoint
+// mapping for endpoint.
+func metadataSupports(endpoint string) bool {
+	_, err := metadataEndpoint(endpoint)
+	return err == nil
+}
+
+// apiProvider is the original source backend: it polls the Cattle API on
+// every scrape via gatherData.
+type apiProvider struct {
+	exporter      *Exporter
+	rancherURL    string
+	resourceLimit string
+	accessKey     string
+	secretKey     string
+	ch            chan<- prometheus.Metric
+}
+
+// Fetch implements Provider by delegating to the existing gatherData codepath.
+func (p *apiProvider) Fetch(ctx context.Context, endpoint string) (*Data, error) {
+	return p.exporter.gatherData(ctx, p.rancherURL, p.resourceLimit, p.accessKey, p.secretKey, endpoint, p.ch)
+}
+
+// metadataEndpoint maps a Data endpoint name to the matching path on the
+// Rancher metadata service. The metadata service has no equivalent of the
+// Cattle API's "nodes" endpoint, so that endpoint has no metadata-backed
+// Provider and falls back to apiProvider even with --rancher.metadata set.
+func metadataEndpoint(endpoint string) (string, error) {
+	switch endpoint {
+	case "hosts":
+		return "/hosts", nil
+	case "stacks":
+		return "/self/stack", nil
+	case "services":
+		return "/services", nil
+	case "clusters":
+		return "/self/cluster", nil
+	default:
+		return "", fmt.Errorf("metadataProvider: unsupported endpoint %s", endpoint)
+	}
+}
+
+// metadataEndpoints lists every Data endpoint metadataEndpoint knows how to
+// translate, i.e. everything watch refreshes on each version change.
+var metadataEndpoints = []string{"hosts", "stacks", "services", "clusters"}
+
+// metadataProvider sources Data from Rancher's unauthenticated metadata
+// service, reached from inside a Rancher-managed stack. Fetch serves from
+// cache, which watch refreshes in the background for the life of the
+// process, on every metadata version change (or, with long polling
+// disabled, every rancher.metadata-poll-interval); Fetch only makes a
+// request itself when cache holds nothing yet for the endpoint.
+type metadataProvider struct {
+	baseURL  string
+	client   *apiClient
+	longPoll bool
+
+	mu    sync.RWMutex
+	cache map[string]*Data
+}
+
+// metadataProviderOnce/sharedMetadataProvider make newMetadataProvider
+// idempotent: provider() calls it on every scrape, but watch must only be
+// started once per process.
+var (
+	metadataProviderOnce   sync.Once
+	sharedMetadataProvider *metadataProvider
+)
+
+// newMetadataProvider returns the process-wide metadataProvider, built from
+// the rancher.metadata.* flags and client, starting its background watch
+// loop the first time it's called.
+func newMetadataProvider(client *apiClient) *metadataProvider {
+	metadataProviderOnce.Do(func() {
+		p := &metadataProvider{
+			baseURL:  *metadataURL,
+			client:   client,
+			longPoll: *metadataLongPoll,
+			cache:    make(map[string]*Data),
+		}
+		go p.watch()
+		sharedMetadataProvider = p
+	})
+	return sharedMetadataProvider
+}
+
+// Fetch returns the most recently cached Data for endpoint. Before watch's
+// first refresh has completed the cache is still empty, so Fetch falls back
+// to fetching endpoint directly rather than returning no data for the first
+// scrape.
+func (p *metadataProvider) Fetch(ctx context.Context, endpoint string) (*Data, error) {
+	p.mu.RLock()
+	data, ok := p.cache[endpoint]
+	p.mu.RUnlock()
+	if ok {
+		return data, nil
+	}
+
+	return p.fetchAndCache(ctx, endpoint)
+}
+
+// fetchAndCache fetches the metadata-service equivalent of the given Cattle
+// endpoint, decodes and converts it into Data, and stores it in cache.
+func (p *metadataProvider) fetchAndCache(ctx context.Context, endpoint string) (*Data, error) {
+	path, err := metadataEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := p.fetchData(ctx, endpoint, path)
+	if err != nil {
+		log.Error("Error getting JSON from metadata service ", endpoint, ": ", err)
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cache[endpoint] = data
+	p.mu.Unlock()
+
+	return data, nil
+}
+
+// fetchData decodes endpoint's metadata-service response and converts it
+// into Data. Unlike the Cattle API, the metadata service returns a bare
+// array ("hosts", "services") or a single bare object ("stacks",
+// "clusters") rather than Data's {"data": [...]} envelope, so each shape is
+// decoded separately and converted into DataItem rather than unmarshalled
+// into Data directly.
+func (p *metadataProvider) fetchData(ctx context.Context, endpoint, path string) (*Data, error) {
+	switch endpoint {
+	case "hosts":
+		var hosts []metadataHost
+		if err := p.getJSON(ctx, endpoint, path, &hosts); err != nil {
+			return nil, err
+		}
+		data := &Data{Data: make([]DataItem, len(hosts))}
+		for i, h := range hosts {
+			data.Data[i] = h.dataItem()
+		}
+		return data, nil
+
+	case "services":
+		var services []metadataService
+		if err := p.getJSON(ctx, endpoint, path, &services); err != nil {
+			return nil, err
+		}
+		data := &Data{Data: make([]DataItem, len(services))}
+		for i, s := range services {
+			data.Data[i] = s.dataItem()
+		}
+		return data, nil
+
+	case "stacks":
+		var stack metadataStack
+		if err := p.getJSON(ctx, endpoint, path, &stack); err != nil {
+			return nil, err
+		}
+		return &Data{Data: []DataItem{stack.dataItem()}}, nil
+
+	case "clusters":
+		var cluster metadataCluster
+		if err := p.getJSON(ctx, endpoint, path, &cluster); err != nil {
+			return nil, err
+		}
+		return &Data{Data: []DataItem{cluster.dataItem()}}, nil
+
+	default:
+		return nil, fmt.Errorf("metadataProvider: unsupported endpoint %s", endpoint)
+	}
+}
+
+// metadataHost is one entry of the Rancher metadata service's GET /hosts
+// array.
+type metadataHost struct {
+	UUID     string            `json:"uuid"`
+	Name     string            `json:"name"`
+	HostName string            `json:"hostname"`
+	State    string            `json:"state"`
+	Labels   map[string]string `json:"labels"`
+}
+
+func (h metadataHost) dataItem() DataItem {
+	return DataItem{ID: h.UUID, Name: h.Name, HostName: h.HostName, State: h.State, Labels: h.Labels, BaseType: "host"}
+}
+
+// metadataService is one entry of the Rancher metadata service's GET
+// /services array.
+type metadataService struct {
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`
+	StackUUID   string `json:"stack_uuid"`
+	State       string `json:"state"`
+	HealthState string `json:"health_state"`
+	Scale       int    `json:"scale"`
+}
+
+func (s metadataService) dataItem() DataItem {
+	return DataItem{ID: s.UUID, Name: s.Name, StackID: s.StackUUID, State: s.State, HealthState: s.HealthState, Scale: s.Scale, BaseType: "service"}
+}
+
+// metadataStack is the object returned by the Rancher metadata service's
+// GET /self/stack.
+type metadataStack struct {
+	UUID        string `json:"uuid"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+	HealthState string `json:"health_state"`
+	System      bool   `json:"system"`
+}
+
+func (s metadataStack) dataItem() DataItem {
+	return DataItem{ID: s.UUID, Name: s.Name, State: s.State, HealthState: s.HealthState, System: s.System, BaseType: "stack"}
+}
+
+// metadataCluster is the object returned by the Rancher metadata service's
+// GET /self/cluster.
+type metadataCluster struct {
+	UUID  string `json:"uuid"`
+	Name  string `json:"name"`
+	State string `json:"state"`
+}
+
+func (c metadataCluster) dataItem() DataItem {
+	return DataItem{ID: c.UUID, Name: c.Name, State: c.State, BaseType: "cluster"}
+}
+
+// getJSON performs a single request against the metadata service, routed
+// through the same apiClient the Cattle API path uses so this gets the same
+// connection reuse, retry/backoff and rancher_api_request* instrumentation
+// instead of a second, unhardened http.Client. The Accept header is
+// required for the metadata service to return JSON instead of its default
+// plain-text rendering.
+func (p *metadataProvider) getJSON(ctx context.Context, endpoint, path string, target interface{}) error {
+	return p.client.GetWithHeaders(ctx, endpoint, p.baseURL+path, map[string]string{"Accept": "application/json"}, target)
+}
+
+// watch blocks on the metadata service's version endpoint, which only
+// responds once the metadata has actually changed, and refreshes cache
+// every time it does. When long polling is disabled it instead ticks on
+// rancher.metadata-poll-interval. It runs for the lifetime of the process
+// once the first scrape selects the metadata provider.
+func (p *metadataProvider) watch() {
+	if !p.longPoll {
+		ticker := time.NewTicker(*metadataPollInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			p.refreshAll()
+		}
+	}
+
+	var lastVersion string
+	for {
+		var version string
+		if err := p.getJSON(context.Background(), "version", "/version", &version); err != nil {
+			log.Error("Error long-polling metadata version: ", err)
+			time.Sleep(*metadataPollInterval)
+			continue
+		}
+
+		if version != lastVersion {
+			lastVersion = version
+			p.refreshAll()
+		}
+	}
+}
+
+// refreshAll re-fetches every metadata-backed endpoint into cache, so a
+// version change is reflected in every endpoint's Data before the next
+// scrape reads it from Fetch.
+func (p *metadataProvider) refreshAll() {
+	for _, endpoint := range metadataEndpoints {
+		if _, err := p.fetchAndCache(context.Background(), endpoint); err != nil {
+			log.Error("Error refreshing metadata cache for ", endpoint, ": ", err)
+		}
+	}
+}
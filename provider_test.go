@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMetadataEndpointRejectsNodes(t *testing.T) {
+	if _, err := metadataEndpoint("nodes"); err == nil {
+		t.Fatalf("metadataEndpoint(nodes) = nil error, want unsupported: the metadata service has no node list, unlike the Cattle API's /nodes")
+	}
+}
+
+// TestProviderFallsBackToAPIForNodesUnderMetadataMode guards against
+// provider() ignoring which endpoint it is being asked for: metadata mode
+// has no "nodes" mapping, so that endpoint must still resolve to
+// apiProvider rather than a metadataProvider whose Fetch always errors.
+func TestProviderFallsBackToAPIForNodesUnderMetadataMode(t *testing.T) {
+	oldEnabled, oldLongPoll, oldInterval := *metadataEnabled, *metadataLongPoll, *metadataPollInterval
+	*metadataEnabled = true
+	*metadataLongPoll = false
+	*metadataPollInterval = time.Hour // keep newMetadataProvider's background watch from ticking during the test
+	defer func() {
+		*metadataEnabled, *metadataLongPoll, *metadataPollInterval = oldEnabled, oldLongPoll, oldInterval
+	}()
+
+	client, err := newAPIClient()
+	if err != nil {
+		t.Fatalf("newAPIClient: %v", err)
+	}
+	e := &Exporter{httpClient: client}
+
+	if _, ok := e.provider("nodes", "", "", "", "", nil).(*apiProvider); !ok {
+		t.Fatalf("provider(nodes, ...) did not return an *apiProvider under --rancher.metadata")
+	}
+	if _, ok := e.provider("hosts", "", "", "", "", nil).(*metadataProvider); !ok {
+		t.Fatalf("provider(hosts, ...) did not return a *metadataProvider under --rancher.metadata")
+	}
+}
+
+// TestMetadataProviderFetchDecodesRealisticPayloads guards against decoding
+// the metadata service's bare array/object responses as if they were
+// Data's {"data": [...]} envelope, which previously yielded zero items (or
+// a decode error) for every metadata-backed endpoint.
+func TestMetadataProviderFetchDecodesRealisticPayloads(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hosts", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`[
+			{"uuid":"1h1","name":"host-a","hostname":"host-a","state":"active"},
+			{"uuid":"1h2","name":"host-b","hostname":"host-b","state":"active"}
+		]`))
+	})
+	mux.HandleFunc("/self/stack", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"uuid":"1st1","name":"my-stack","state":"active","health_state":"healthy","system":false}`))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	client, err := newAPIClient()
+	if err != nil {
+		t.Fatalf("newAPIClient: %v", err)
+	}
+	p := &metadataProvider{baseURL: server.URL, client: client, cache: make(map[string]*Data)}
+
+	hosts, err := p.Fetch(context.Background(), "hosts")
+	if err != nil {
+		t.Fatalf("Fetch(hosts): %v", err)
+	}
+	if len(hosts.Data) != 2 {
+		t.Fatalf("got %d hosts, want 2: a bare JSON array must decode into distinct items, not be folded into a single entry", len(hosts.Data))
+	}
+	if hosts.Data[0].Name != "host-a" || hosts.Data[1].Name != "host-b" {
+		t.Fatalf("host names = %q, %q, want host-a, host-b", hosts.Data[0].Name, hosts.Data[1].Name)
+	}
+
+	stacks, err := p.Fetch(context.Background(), "stacks")
+	if err != nil {
+		t.Fatalf("Fetch(stacks): %v", err)
+	}
+	if len(stacks.Data) != 1 || stacks.Data[0].Name != "my-stack" {
+		t.Fatalf("stacks.Data = %+v, want a single my-stack entry", stacks.Data)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// refCacheTTL bounds how long a stackRef/clusterRef entry survives without
+// being refreshed by a subsequent scrape. Without it, a stack or cluster
+// removed from Rancher would keep showing up as a label value forever.
+const refCacheTTL = 10 * time.Minute
+
+// refCacheEntry pairs a cached name with the last time it was set, so Get
+// can treat stale entries as misses without a separate janitor goroutine.
+type refCacheEntry struct {
+	name string
+	set  time.Time
+}
+
+// RefCache is a concurrency-safe replacement for the stackRef/clusterRef
+// globals: Get/Set are O(1) map operations under a single RWMutex, instead
+// of the O(n) range retrieveStackRef/retrieveClusterRef used to perform on
+// every service/node processed, and Set no longer races when scrapes run
+// concurrently.
+type RefCache struct {
+	sync.RWMutex
+	m   map[string]refCacheEntry
+	ttl time.Duration
+}
+
+// NewRefCache returns an empty RefCache with the default TTL.
+func NewRefCache() *RefCache {
+	return &RefCache{
+		m:   make(map[string]refCacheEntry),
+		ttl: refCacheTTL,
+	}
+}
+
+// Get returns the name stored for id, and false if id has never been seen
+// or its entry has expired. An expired entry is evicted from the
+// underlying map on read, so ids Rancher stops reporting (and the cache is
+// never Set for again) are eventually freed rather than retained forever.
+func (c *RefCache) Get(id string) (string, bool) {
+	c.RLock()
+	entry, ok := c.m[id]
+	c.RUnlock()
+
+	if !ok {
+		return "", false
+	}
+
+	if time.Since(entry.set) > c.ttl {
+		c.Lock()
+		// Re-check under the write lock: a concurrent Set may have
+		// refreshed this id since we released the read lock above.
+		if current, ok := c.m[id]; ok && current.set == entry.set {
+			delete(c.m, id)
+		}
+		c.Unlock()
+		return "", false
+	}
+
+	return entry.name, true
+}
+
+// Set stores name for id, refreshing its TTL.
+func (c *RefCache) Set(id, name string) {
+	c.Lock()
+	c.m[id] = refCacheEntry{name: name, set: time.Now()}
+	c.Unlock()
+}
+
+// GetOrUnknown mirrors the "unknown" fallback retrieveStackRef/
+// retrieveClusterRef used, so callers don't need to special-case the miss.
+func (c *RefCache) GetOrUnknown(id string) string {
+	if id == "" {
+		return "unknown"
+	}
+	if name, ok := c.Get(id); ok {
+		return name
+	}
+	return "unknown"
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestRefCacheGetSet(t *testing.T) {
+	c := NewRefCache()
+
+	if _, ok := c.Get("missing"); ok {
+		t.Fatalf("expected miss for an unseen id")
+	}
+	if got := c.GetOrUnknown("missing"); got != "unknown" {
+		t.Fatalf("GetOrUnknown(missing) = %q, want unknown", got)
+	}
+
+	c.Set("1st1", "stack-a")
+	if got := c.GetOrUnknown("1st1"); got != "stack-a" {
+		t.Fatalf("GetOrUnknown(1st1) = %q, want stack-a", got)
+	}
+}
+
+func TestRefCacheConcurrentAccess(t *testing.T) {
+	c := NewRefCache()
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		id := strconv.Itoa(i)
+		go func() {
+			defer wg.Done()
+			c.Set(id, "name-"+id)
+		}()
+		go func() {
+			defer wg.Done()
+			c.GetOrUnknown(id)
+		}()
+	}
+
+	wg.Wait()
+}
+
+// BenchmarkRefCacheGet demonstrates the O(1) lookup RefCache gives over the
+// O(n) range-over-map retrieveStackRef/retrieveClusterRef used to do, at a
+// scale representative of a large Rancher environment.
+func BenchmarkRefCacheGet(b *testing.B) {
+	c := NewRefCache()
+	for i := 0; i < 10000; i++ {
+		c.Set(fmt.Sprintf("stack-%d", i), fmt.Sprintf("name-%d", i))
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.GetOrUnknown("stack-9999")
+	}
+}
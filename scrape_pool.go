@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	scrapeConcurrency = kingpin.Flag("scrape.concurrency", "Number of endpoints to scrape in parallel.").Default("5").Int()
+
+	scrapeTimeout = kingpin.Flag("scrape.timeout", "Per-scrape deadline applied to every endpoint fetched during a Collect.").Default("10s").Duration()
+)
+
+// endpointScrapeErrors counts failed endpoint fetches by endpoint, so a
+// single slow/broken Rancher resource type doesn't silently disappear from
+// an otherwise-healthy scrape.
+var endpointScrapeErrors = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Name: "rancher_endpoint_scrape_errors_total",
+		Help: "Total number of failed scrapes per Rancher API endpoint",
+	},
+	[]string{"endpoint"},
+)
+
+func init() {
+	prometheus.MustRegister(endpointScrapeErrors)
+}
+
+// scrapeResult carries one endpoint's fetch outcome back to the consumer.
+// Exactly one of data/v3Data is set on success, depending on
+// *rancherAPIVersion.
+type scrapeResult struct {
+	endpoint string
+	data     *Data
+	v3Data   *V3Data
+	err      error
+}
+
+// scrapePhases groups endpoints so that every endpoint whose processing
+// populates a ref cache (stackRef/clusterRef/projectRef) is fetched and
+// processed to completion before the phase that reads it starts. Endpoints
+// within a phase have no such dependency on one another and are scraped
+// concurrently; phases themselves run in order.
+func scrapePhases() [][]string {
+	if *rancherAPIVersion == apiVersionV3 {
+		return [][]string{
+			{"clusters"},          // populates clusterRef
+			{"projects", "nodes"}, // projects populates projectRef; both read clusterRef
+			{"workloads", "pods"}, // read projectRef/clusterRef
+		}
+	}
+	return [][]string{
+		{"hosts", "stacks", "clusters"}, // stacks/clusters populate stackRef/clusterRef
+		{"services", "nodes"},           // read stackRef/clusterRef
+	}
+}
+
+// scrapeAll fetches every endpoint in endpoints concurrently, bounded by
+// scrape.concurrency goroutines, all scoped to ctx. Results are returned as
+// a channel so the caller can process whichever endpoint finishes first. A
+// failure fetching one endpoint is recorded via
+// rancher_endpoint_scrape_errors_total and does not block the others.
+func (e *Exporter) scrapeAll(ctx context.Context, rancherURL, resourceLimit, accessKey, secretKey string, endpoints []string, ch chan<- prometheus.Metric) <-chan scrapeResult {
+	urlChan := make(chan string, len(endpoints))
+	for _, endpoint := range endpoints {
+		urlChan <- endpoint
+	}
+	close(urlChan)
+
+	results := make(chan scrapeResult, len(endpoints))
+
+	workers := *scrapeConcurrency
+	if workers > len(endpoints) {
+		workers = len(endpoints)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for endpoint := range urlChan {
+				results <- e.scrapeOne(ctx, rancherURL, resourceLimit, accessKey, secretKey, endpoint, ch)
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
+
+// scrapeOne fetches a single endpoint, binding the request to ctx so that
+// ctx expiring cancels the in-flight request rather than abandoning the
+// goroutine waiting on it. A failure is recorded via
+// rancher_endpoint_scrape_errors_total rather than aborting the scrape.
+func (e *Exporter) scrapeOne(ctx context.Context, rancherURL, resourceLimit, accessKey, secretKey, endpoint string, ch chan<- prometheus.Metric) scrapeResult {
+	type fetched struct {
+		data   *Data
+		v3Data *V3Data
+		err    error
+	}
+
+	done := make(chan fetched, 1)
+	go func() {
+		if *rancherAPIVersion == apiVersionV3 {
+			data, err := e.gatherDataV3(ctx, rancherURL, resourceLimit, accessKey, secretKey, endpoint, ch)
+			done <- fetched{v3Data: data, err: err}
+			return
+		}
+
+		data, err := e.provider(endpoint, rancherURL, resourceLimit, accessKey, secretKey, ch).Fetch(ctx, endpoint)
+		done <- fetched{data: data, err: err}
+	}()
+
+	select {
+	case f := <-done:
+		if f.err != nil {
+			endpointScrapeErrors.WithLabelValues(endpoint).Inc()
+			log.Error("Error scraping endpoint ", endpoint, ": ", f.err)
+			return scrapeResult{endpoint: endpoint, err: f.err}
+		}
+		return scrapeResult{endpoint: endpoint, data: f.data, v3Data: f.v3Data}
+	case <-ctx.Done():
+		endpointScrapeErrors.WithLabelValues(endpoint).Inc()
+		log.Error("Timed out scraping endpoint ", endpoint, ": ", ctx.Err())
+		return scrapeResult{endpoint: endpoint, err: ctx.Err()}
+	}
+}
+
+// collectConcurrently is the body of Exporter.Collect: every endpoint in a
+// phase is scraped concurrently, but collectConcurrently waits for a phase
+// to fully drain before starting the next, so services/nodes (and v3's
+// projects/nodes/workloads/pods) never get processed ahead of the
+// stacks/clusters (or clusters/projects) scrape that populates the ref
+// cache they read. scrape.timeout applies once, to the whole Collect.
+func (e *Exporter) collectConcurrently(rancherURL, resourceLimit, accessKey, secretKey string, hideSys bool, ch chan<- prometheus.Metric) {
+	start := time.Now()
+	defer func() {
+		log.Debugf("Concurrent scrape took %s", time.Since(start))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *scrapeTimeout)
+	defer cancel()
+
+	for _, phase := range scrapePhases() {
+		for result := range e.scrapeAll(ctx, rancherURL, resourceLimit, accessKey, secretKey, phase, ch) {
+			if result.err != nil {
+				continue
+			}
+
+			if result.v3Data != nil {
+				if err := e.processV3Metrics(result.v3Data, result.endpoint, ch); err != nil {
+					log.Error("Error processing v3 metrics for ", result.endpoint, ": ", err)
+				}
+				continue
+			}
+
+			if err := e.processMetrics(result.data, result.endpoint, hideSys, ch); err != nil {
+				log.Error("Error processing metrics for ", result.endpoint, ": ", err)
+			}
+		}
+	}
+}
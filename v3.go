@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+const (
+	apiVersionV2Beta = "v2-beta"
+	apiVersionV3     = "v3"
+)
+
+var (
+	rancherAPIVersion = kingpin.Flag("rancher.api-version", "Rancher API version to talk to: v2-beta (Cattle, Rancher 1.x) or v3 (Rancher 2.x / Kubernetes).").Default(apiVersionV2Beta).Enum(apiVersionV2Beta, apiVersionV3)
+
+	rancherBearerToken = kingpin.Flag("rancher.bearer-token", "Bearer token used to authenticate against the Rancher v3 API, in place of --rancher.access-key/--rancher.secret-key.").Default("").String()
+)
+
+// V3Data is the Rancher v3 analogue of Data: the v3 API returns the same
+// paginated {"data": [...]} envelope, but the objects inside describe
+// Kubernetes-shaped resources rather than Cattle ones.
+type V3Data struct {
+	Data []V3Item `json:"data"`
+}
+
+// V3Item covers the fields processV3Metrics needs from /v3/clusters,
+// /v3/nodes, /v3/projects, /v3/workloads and /v3/pods. Like the Cattle Data
+// item, state is a plain string directly on the object.
+type V3Item struct {
+	ID           string            `json:"id"`
+	Name         string            `json:"name"`
+	ClusterID    string            `json:"clusterId"`
+	ProjectID    string            `json:"projectId"`
+	State        string            `json:"state"`
+	Labels       map[string]string `json:"labels"`
+	Scale        int               `json:"scale"`
+	WorkloadType string            `json:"type"`
+
+	// NodeName is only populated on /v3/nodes.
+	NodeName string `json:"nodeName"`
+
+	// AvailableReplicas/DesiredReplicas are only populated on /v3/workloads.
+	AvailableReplicas int `json:"availableReplicas"`
+	DesiredReplicas   int `json:"desiredReplicas"`
+
+	// PodStatus is only populated on /v3/pods.
+	PodStatus string `json:"podStatus"`
+}
+
+// registerV3Families declares the Rancher 2.x metric families, so that
+// --metric-allowlist/--metric-denylist apply to them like the v2-beta
+// families. It is only called from newRegistry when
+// --rancher.api-version=v3 is selected. V3Item is decoded from a different
+// endpoint shape than DataItem, so these families emit via
+// emitV3Metric/processV3Item instead of Generate, which is left nil here.
+func (r *registry) registerV3Families() {
+	r.register(&MetricFamily{
+		Name:      "rancher_cluster_state",
+		Help:      "State of the cluster (1 active, 0 for others)",
+		Endpoint:  "clusters",
+		Labels:    []string{"name", "state"},
+		ValueType: prometheus.GaugeValue,
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_project_state",
+		Help:      "State of the Rancher project (1 active, 0 for others)",
+		Endpoint:  "projects",
+		Labels:    []string{"name", "cluster_name", "state"},
+		ValueType: prometheus.GaugeValue,
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_workload_scale",
+		Help:      "Requested scale of the workload",
+		Endpoint:  "workloads",
+		Labels:    []string{"name", "project_name", "cluster_name"},
+		ValueType: prometheus.GaugeValue,
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_workload_available_replicas",
+		Help:      "Available replicas for the workload",
+		Endpoint:  "workloads",
+		Labels:    []string{"name", "project_name", "cluster_name"},
+		ValueType: prometheus.GaugeValue,
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_node_state",
+		Help:      "State of the node (1 active, 0 for others)",
+		Endpoint:  "nodes",
+		Labels:    []string{"name", "cluster_name", "state"},
+		ValueType: prometheus.GaugeValue,
+	})
+
+	r.register(&MetricFamily{
+		Name:      "rancher_pod_state",
+		Help:      "Status of the pod, e.g. Running, Pending, Failed",
+		Endpoint:  "pods",
+		Labels:    []string{"name", "project_name", "status"},
+		ValueType: prometheus.GaugeValue,
+	})
+}
+
+// processV3Item emits metrics for a single v3 resource, reusing
+// storeClusterRef/retrieveClusterRef so clusters discovered via /v3/clusters
+// attach a cluster_name label to nodes/projects/workloads exactly the way
+// stacks attach stack_name to services today. Pods carry project_name only.
+func (e *Exporter) processV3Item(endpoint string, x *V3Item, ch chan<- prometheus.Metric) {
+	switch endpoint {
+	case "clusters":
+		storeClusterRef(x.ID, x.Name)
+		e.emitV3Metric(ch, "rancher_cluster_state", 1, x.Name, x.State)
+
+	case "nodes":
+		clusterName := retrieveClusterRef(x.ClusterID)
+		e.emitV3Metric(ch, "rancher_node_state", 1, x.NodeName, clusterName, x.State)
+
+	case "projects":
+		storeProjectRef(x.ID, x.Name)
+		clusterName := retrieveClusterRef(x.ClusterID)
+		e.emitV3Metric(ch, "rancher_project_state", 1, x.Name, clusterName, x.State)
+
+	case "workloads":
+		projectName := retrieveProjectRef(x.ProjectID)
+		clusterName := retrieveClusterRef(x.ClusterID)
+		e.emitV3Metric(ch, "rancher_workload_scale", float64(x.DesiredReplicas), x.Name, projectName, clusterName)
+		e.emitV3Metric(ch, "rancher_workload_available_replicas", float64(x.AvailableReplicas), x.Name, projectName, clusterName)
+
+	case "pods":
+		projectName := retrieveProjectRef(x.ProjectID)
+		e.emitV3Metric(ch, "rancher_pod_state", 1, x.Name, projectName, x.PodStatus)
+	}
+}
+
+// emitV3Metric looks up the family by name and sends a single const metric
+// built from labelValues, so v3 resources reuse the same Desc machinery as
+// the v2-beta generators instead of constructing descriptors ad hoc.
+func (e *Exporter) emitV3Metric(ch chan<- prometheus.Metric, name string, value float64, labelValues ...string) {
+	for _, family := range e.metricRegistry.families {
+		if family.Name != name {
+			continue
+		}
+		desc := prometheus.NewDesc(family.Name, family.Help, family.Labels, nil)
+		ch <- prometheus.MustNewConstMetric(desc, family.ValueType, value, labelValues...)
+		return
+	}
+}
+
+// processV3Metrics is the v3 analogue of processMetrics: it ranges over a
+// V3Data payload, emitting metrics for each item via processV3Item.
+func (e *Exporter) processV3Metrics(data *V3Data, endpoint string, ch chan<- prometheus.Metric) error {
+	for i := range data.Data {
+		e.processV3Item(endpoint, &data.Data[i], ch)
+	}
+	return nil
+}
+
+// gatherDataV3 is the v3 analogue of gatherData: it fetches a /v3/<endpoint>
+// page and decodes it into V3Data rather than the Cattle-shaped Data. It is
+// the codepath scrapeOne uses once --rancher.api-version=v3 is selected.
+func (e *Exporter) gatherDataV3(ctx context.Context, rancherURL, resourceLimit, accessKey, secretKey, endpoint string, ch chan<- prometheus.Metric) (*V3Data, error) {
+	url := setEndpoint(rancherURL, endpoint, resourceLimit)
+
+	data := new(V3Data)
+	err := e.httpClient.Get(ctx, endpoint, url, accessKey, secretKey, data)
+	if err != nil {
+		log.Error("Error getting JSON from endpoint ", endpoint, ": ", err)
+		return nil, err
+	}
+	log.Debugf("JSON Fetched for: "+endpoint+": %+v", data)
+
+	return data, nil
+}
+
+// projectRef maps a Rancher v3 projectID to its display name, mirroring
+// stackRef/clusterRef.
+var projectRef = NewRefCache()
+
+// storeProjectRef stores the projectID and project name for use as a label
+// elsewhere, mirroring storeStackRef/storeClusterRef.
+func storeProjectRef(projectID string, projectName string) {
+	projectRef.Set(projectID, projectName)
+}
+
+// retrieveProjectRef returns the project name, when sending the projectID.
+func retrieveProjectRef(projectID string) string {
+	return projectRef.GetOrUnknown(projectID)
+}